@@ -1,45 +1,302 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/jedib0t/go-pretty/v6/progress"
+	"github.com/twmb/murmur3"
+	"go.etcd.io/bbolt"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Partition struct {
 	current int64
 	max     int64
-	errored bool
+	errored int32 // accessed atomically: mutated by the owning worker, read by checkpoint snapshots
 }
 
 type Config struct {
-	partitions int
-	max        int64
-	min        int64
-	file       *os.File
-	writer     progress.Writer
-	fileSize   int64
-	iterations int
-	outlier    int64
+	partitions      int
+	max             int64
+	min             int64
+	file            *os.File
+	writer          progress.Writer
+	fileSize        int64
+	iterations      int
+	outlier         int64
+	workers         int
+	stateDir        string
+	checkpointEvery int64
+	reset           bool
+	ctx             context.Context
+	onCheckpoint    func(offset int64) // test hook, called after each successful checkpoint commit
+	hasher          Hasher
+	maxRecords      int64
+	partitionFilter []int
+	resumeFrom      *ResumeToken
 }
 
 type Result struct {
 	totalDocuments  int64
 	totalIDs        int64
 	partitionCounts []int64
+	resumeToken     ResumeToken
+}
+
+// ResumeToken is the pagination handle ProcessCSV emits when
+// config.maxRecords is reached before the file is exhausted: enough to pick
+// up exactly where this invocation stopped via config.resumeFrom, without
+// needing a config.stateDir. Unlike Config and Result, its fields are
+// exported and JSON-tagged because it is meant to be written out and read
+// back by a later invocation (e.g. the CLI's --partition-filter chunking).
+type ResumeToken struct {
+	Offset           int64   `json:"offset"`
+	PartitionCurrent []int64 `json:"partitionCurrent"`
+	PartitionErrored []bool  `json:"partitionErrored"`
+}
+
+// workItem is a parsed CSV row handed off from the reader goroutine to the
+// worker that owns its partition.
+type workItem struct {
+	documentID     uint32
+	count          int64
+	partitionIndex int
+}
+
+// progressBatch controls how many records a worker accumulates before
+// issuing a single Increment call, so go-pretty's tracker locking doesn't
+// become a new bottleneck once the hashing and tracker updates are spread
+// across goroutines.
+const progressBatch = 200
+
+// stopper fans out goroutines and cleanly waits for all of them to exit.
+type stopper struct {
+	wg    sync.WaitGroup
+	stopc chan struct{}
+}
+
+func newStopper() *stopper {
+	return &stopper{stopc: make(chan struct{})}
+}
+
+func (s *stopper) RunWorker(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+func (s *stopper) ShouldStop() chan struct{} {
+	return s.stopc
+}
+
+func (s *stopper) Stop() {
+	close(s.stopc)
+	s.wg.Wait()
+}
+
+// errInterrupted is returned by ProcessCSV when config.ctx is canceled
+// (SIGINT/SIGTERM). When config.stateDir is set, a final checkpoint has been
+// committed to it first; without a state dir nothing is persisted.
+var errInterrupted = errors.New("processing interrupted, state checkpointed for resume")
+
+// errMaxRecordsReached is returned by ProcessCSV when config.maxRecords rows
+// have been processed for this invocation, with result.resumeToken populated
+// so a follow-up call can pick up where this one left off via
+// config.resumeFrom.
+var errMaxRecordsReached = errors.New("max records reached for this invocation, resume token available")
+
+var (
+	metaBucketName       = []byte("meta")
+	partitionsBucketName = []byte("partitions")
+	outliersBucketName   = []byte("outliers")
+)
+
+// stateStore persists partition state to a BoltDB file under a configured
+// state directory so a run can be checkpointed and later resumed.
+type stateStore struct {
+	db *bbolt.DB
+}
+
+func openStore(config Config) (*stateStore, error) {
+	if config.stateDir == "" {
+		return nil, nil
+	}
+
+	if config.reset {
+		if err := os.RemoveAll(config.stateDir); err != nil {
+			return nil, fmt.Errorf("error resetting state dir: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(config.stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating state dir: %w", err)
+	}
+
+	db, err := bbolt.Open(filepath.Join(config.stateDir, "state.db"), 0o600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening state store: %w", err)
+	}
+
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// restore loads a previously checkpointed run into partitionList, result and
+// loggedOutliers, returning the CSV byte offset processing stopped at. An
+// offset of 0 means there is nothing to resume.
+func (s *stateStore) restore(partitionList []Partition, result *Result, loggedOutliers map[uint32]bool) (int64, error) {
+	var offset int64
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucketName)
+		if meta == nil {
+			return nil // fresh state store, nothing to restore
+		}
+
+		if v := meta.Get([]byte("offset")); v != nil {
+			offset = decodeInt64(v)
+		}
+		if v := meta.Get([]byte("totalDocuments")); v != nil {
+			result.totalDocuments = decodeInt64(v)
+		}
+		if v := meta.Get([]byte("totalIDs")); v != nil {
+			result.totalIDs = decodeInt64(v)
+		}
+
+		if partitions := tx.Bucket(partitionsBucketName); partitions != nil {
+			for i := range partitionList {
+				v := partitions.Get(encodeInt64(int64(i)))
+				if len(v) != 9 {
+					continue
+				}
+				partitionList[i].current = decodeInt64(v[:8])
+				if v[8] != 0 {
+					partitionList[i].errored = 1
+				}
+				result.partitionCounts[i] = partitionList[i].current
+			}
+		}
+
+		if outliers := tx.Bucket(outliersBucketName); outliers != nil {
+			c := outliers.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				loggedOutliers[binary.BigEndian.Uint32(k)] = true
+			}
+		}
+
+		return nil
+	})
+
+	return offset, err
+}
+
+// checkpoint commits a consistent snapshot of partitionList, result and
+// loggedOutliers, along with the CSV byte offset to resume from, in a single
+// write transaction.
+func (s *stateStore) checkpoint(partitionList []Partition, result Result, loggedOutliers map[uint32]bool, offset int64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("offset"), encodeInt64(offset)); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("totalDocuments"), encodeInt64(result.totalDocuments)); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("totalIDs"), encodeInt64(result.totalIDs)); err != nil {
+			return err
+		}
+
+		partitions, err := tx.CreateBucketIfNotExists(partitionsBucketName)
+		if err != nil {
+			return err
+		}
+		for i := range partitionList {
+			current := atomic.LoadInt64(&partitionList[i].current)
+			errored := byte(0)
+			if atomic.LoadInt32(&partitionList[i].errored) != 0 {
+				errored = 1
+			}
+			if err := partitions.Put(encodeInt64(int64(i)), append(encodeInt64(current), errored)); err != nil {
+				return err
+			}
+		}
+
+		outliers, err := tx.CreateBucketIfNotExists(outliersBucketName)
+		if err != nil {
+			return err
+		}
+		for id := range loggedOutliers {
+			key := make([]byte, 4)
+			binary.BigEndian.PutUint32(key, id)
+			if err := outliers.Put(key, []byte{1}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func encodeInt64(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func decodeInt64(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// buildResumeToken snapshots partitionList into a ResumeToken a caller can
+// pass back in as config.resumeFrom to continue from offset.
+func buildResumeToken(partitionList []Partition, offset int64) ResumeToken {
+	token := ResumeToken{
+		Offset:           offset,
+		PartitionCurrent: make([]int64, len(partitionList)),
+		PartitionErrored: make([]bool, len(partitionList)),
+	}
+	for i := range partitionList {
+		token.PartitionCurrent[i] = atomic.LoadInt64(&partitionList[i].current)
+		token.PartitionErrored[i] = atomic.LoadInt32(&partitionList[i].errored) != 0
+	}
+	return token
 }
 
 func main() {
 	config := parseFlags()
 	defer config.file.Close()
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	config.ctx = ctx
+
 	go config.writer.Render()
 
 	for !config.writer.IsRenderInProgress() {
@@ -47,7 +304,23 @@ func main() {
 		time.Sleep(10 * time.Millisecond)
 	}
 
-	if _, err := ProcessCSV(config); err != nil {
+	result, err := ProcessCSV(config)
+	if err != nil {
+		if errors.Is(err, errInterrupted) {
+			fmt.Printf("%v\n", err)
+			config.writer.Stop()
+			os.Exit(0)
+		}
+		if errors.Is(err, errMaxRecordsReached) {
+			config.writer.Stop()
+			tokenJSON, marshalErr := json.Marshal(result.resumeToken)
+			if marshalErr != nil {
+				fmt.Printf("Error encoding resume token: %v\n", marshalErr)
+				os.Exit(1)
+			}
+			fmt.Println(string(tokenJSON))
+			os.Exit(0)
+		}
 		fmt.Printf("Error processing CSV: %v\n", err)
 		os.Exit(1)
 	}
@@ -62,11 +335,61 @@ func parseFlags() Config {
 	flag.Int64Var(&config.min, "min", 1, "Minimum value for each partition")
 	flag.IntVar(&config.iterations, "iterations", 1, "Number of times to process the CSV file")
 	flag.Int64Var(&config.outlier, "outlier", math.MaxInt64, "Outlier threshold for document count. Documents with more than this count are logged and skipped.")
+	flag.IntVar(&config.workers, "workers", runtime.NumCPU(), "Number of worker goroutines for partition accounting")
+	flag.StringVar(&config.stateDir, "state-dir", "", "Directory for persisting partition state so an interrupted run can be resumed")
+	flag.Int64Var(&config.checkpointEvery, "checkpoint-every", 100000, "Commit a state checkpoint every N processed rows when -state-dir is set")
+	flag.BoolVar(&config.reset, "reset", false, "Wipe the state directory before starting instead of resuming from it")
+	flag.Int64Var(&config.maxRecords, "max-records", 0, "Stop after processing this many rows and print a JSON resume token (0 means no limit)")
+
+	var partitionFilterSpec string
+	flag.StringVar(&partitionFilterSpec, "partition-filter", "", "Comma-separated list of partition indexes or ranges (e.g. 0-63,100) to restrict accounting to")
+	var resumeFromPath string
+	flag.StringVar(&resumeFromPath, "resume-from", "", "Path to a JSON resume token printed by a previous -max-records run")
+
+	var hasherName string
+	flag.StringVar(&hasherName, "hasher", "postgres", "Hash strategy for partitioning: postgres, fnv1a, murmur3, or crc32")
+	var printDistribution bool
+	flag.BoolVar(&printDistribution, "print-distribution", false, "Print a chi-squared uniformity report for every hash strategy and exit")
 
 	var csvFile string
 	flag.StringVar(&csvFile, "file", "", "CSV file to process")
 	flag.Parse()
 
+	if printDistribution {
+		printDistributionReport(config.partitions)
+		os.Exit(0)
+	}
+
+	hasher, err := NewHasher(hasherName)
+	if err != nil {
+		fmt.Printf("Error selecting hasher: %v\n", err)
+		os.Exit(1)
+	}
+	config.hasher = hasher
+
+	if partitionFilterSpec != "" {
+		filter, err := parsePartitionFilter(partitionFilterSpec)
+		if err != nil {
+			fmt.Printf("Error parsing -partition-filter: %v\n", err)
+			os.Exit(1)
+		}
+		config.partitionFilter = filter
+	}
+
+	if resumeFromPath != "" {
+		data, err := os.ReadFile(resumeFromPath)
+		if err != nil {
+			fmt.Printf("Error reading -resume-from token: %v\n", err)
+			os.Exit(1)
+		}
+		var token ResumeToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			fmt.Printf("Error parsing -resume-from token: %v\n", err)
+			os.Exit(1)
+		}
+		config.resumeFrom = &token
+	}
+
 	if csvFile == "" {
 		fmt.Println("Please provide a CSV file name using the -file flag")
 		os.Exit(1)
@@ -102,9 +425,41 @@ func parseFlags() Config {
 }
 
 func ProcessCSV(config Config) (Result, error) {
+	ctx := config.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	hasher := config.hasher
+	if hasher == nil {
+		hasher = postgresHasher{}
+	}
+
+	// When config.partitions is a power of two, reduce the hash with a mask
+	// instead of a modulo. In principle `&` is a single instruction where
+	// `%` is a division, but BenchmarkProcessCSV/partitions=1023 vs
+	// partitions=1024 (otherwise identical, isolating just the mod-vs-mask
+	// choice) comes out within noise of each other - the CSV parsing ahead
+	// of this call dominates per-record cost, so keep the mask path for the
+	// common power-of-two partition counts but don't oversell it as a
+	// measured win.
+	partitionIndexFn := func(h uint32) int { return int(h % uint32(config.partitions)) }
+	if config.partitions > 0 && config.partitions&(config.partitions-1) == 0 {
+		mask := uint32(config.partitions - 1)
+		partitionIndexFn = func(h uint32) int { return int(h & mask) }
+	}
+
 	partitionList := make([]Partition, config.partitions)
 	for i := range partitionList {
-		partitionList[i] = Partition{current: config.min, max: config.max, errored: false}
+		partitionList[i] = Partition{current: config.min, max: config.max}
+	}
+
+	store, err := openStore(config)
+	if err != nil {
+		return Result{}, err
+	}
+	if store != nil {
+		defer store.Close()
 	}
 
 	overallTracker := &progress.Tracker{
@@ -130,43 +485,182 @@ func ProcessCSV(config Config) (Result, error) {
 		partitionCounts: make([]int64, config.partitions),
 	}
 
-	erroredPartitions := 0
-	var pinnedMessages []string
 	loggedOutliers := make(map[uint32]bool)
+
+	// startOffset is only honored for the first of config.iterations passes;
+	// subsequent passes always re-read the file from the start, same as a
+	// non-resumed run.
+	var startOffset int64
+	if store != nil {
+		startOffset, err = store.restore(partitionList, &result, loggedOutliers)
+		if err != nil {
+			return result, fmt.Errorf("error restoring state: %w", err)
+		}
+	} else if config.resumeFrom != nil {
+		startOffset = config.resumeFrom.Offset
+		for i := range partitionList {
+			if i < len(config.resumeFrom.PartitionCurrent) {
+				partitionList[i].current = config.resumeFrom.PartitionCurrent[i]
+				result.partitionCounts[i] = partitionList[i].current
+			}
+			if i < len(config.resumeFrom.PartitionErrored) && config.resumeFrom.PartitionErrored[i] {
+				partitionList[i].errored = 1
+			}
+		}
+	}
+
+	// partitionFilterSet restricts routing and partition accounting to the
+	// requested partitions; rows that hash outside of it still advance
+	// overallTracker and are counted in result.totalDocuments and
+	// result.totalIDs, but are not dispatched to a worker or counted against
+	// any partition, so a simulation can be
+	// divided into many short, independent runs over disjoint partition
+	// ranges.
+	var partitionFilterSet map[int]bool
+	if len(config.partitionFilter) > 0 {
+		partitionFilterSet = make(map[int]bool, len(config.partitionFilter))
+		for _, p := range config.partitionFilter {
+			partitionFilterSet[p] = true
+		}
+	}
+
+	// See BenchmarkWorkerScaling for why -workers isn't the lever to reach
+	// for if ProcessCSV needs to get faster.
+	numWorkers := config.workers
+	if numWorkers <= 0 {
+		numWorkers = 1
+	}
+	if numWorkers > config.partitions {
+		numWorkers = config.partitions
+	}
+
+	// ready is buffered so the reader can hand off a row and move on to
+	// parsing the next one instead of rendezvousing with the owning worker
+	// on every send; an unbuffered channel makes every dispatch a
+	// synchronous handshake and leaves nothing for the worker pool to
+	// actually parallelize. The buffer is sized like progressBatch rather
+	// than deep, so the reader can race at most a small, bounded number of
+	// rows ahead of the workers applying them. Because a worker never exits
+	// early now (it only stops once its channel is closed or every
+	// partition has errored - see runPartitionWorker), a buffered send can
+	// never outlive something willing to read it, so there's no drain/retire
+	// bookkeeping needed to keep dispatched/applied in sync.
+	ready := make([]chan workItem, numWorkers)
+	for w := range ready {
+		ready[w] = make(chan workItem, progressBatch)
+	}
+
+	// erroredPartitions is seeded from partitionList's restored state so a
+	// resumed run that already has errored partitions reports them in the
+	// final error instead of only counting new errors from this invocation.
+	var erroredPartitions int64
+	for i := range partitionList {
+		if atomic.LoadInt32(&partitionList[i].errored) != 0 {
+			erroredPartitions++
+		}
+	}
+
+	allErrored := make(chan struct{})
+	var allErroredOnce sync.Once
+	if erroredPartitions == int64(config.partitions) {
+		allErroredOnce.Do(func() { close(allErrored) })
+	}
+
+	// dispatched is only ever written by the reader; applied is only ever
+	// written by the worker it belongs to. A periodic checkpoint compares
+	// the two (see waitForWorkersCaughtUp) to make sure it never snapshots
+	// partitionList while a dispatched row is still in flight.
+	dispatched := make([]int64, numWorkers)
+	applied := make([]int64, numWorkers)
+
+	stop := newStopper()
+	for w := 0; w < numWorkers; w++ {
+		w := w
+		stop.RunWorker(func() {
+			runPartitionWorker(w, numWorkers, config, ready[w], partitionList, partitionTrackers, result.partitionCounts, &erroredPartitions, allErrored, &allErroredOnce, &applied[w])
+		})
+	}
+
+	var pinnedMessages []string
 	overallPosition := int64(0)
+	rowsSinceCheckpoint := int64(0)
+	recordsThisInvocation := int64(0)
+	interrupted := false
+	maxRecordsReached := false
+	lastOffset := startOffset
 
+readLoop:
 	for iteration := 1; iteration <= config.iterations; iteration++ {
 		position, err := config.file.Seek(0, io.SeekCurrent)
 		if err != nil {
+			for _, ch := range ready {
+				close(ch)
+			}
+			stop.Stop()
 			return result, fmt.Errorf("error getting file position: %w", err)
 		}
 		overallPosition += position
 
-		_, err = config.file.Seek(0, 0) // Reset file pointer to the beginning
+		seekTo := int64(0)
+		skipHeader := true
+		if iteration == 1 && startOffset > 0 {
+			seekTo = startOffset
+			skipHeader = false
+		}
+
+		_, err = config.file.Seek(seekTo, 0)
 		if err != nil {
+			for _, ch := range ready {
+				close(ch)
+			}
+			stop.Stop()
 			return result, fmt.Errorf("error resetting file position: %w", err)
 		}
 
 		reader := csv.NewReader(config.file)
 
-		// Skip header
-		if _, err = reader.Read(); err != nil {
-			return result, fmt.Errorf("error reading CSV header: %w", err)
+		if skipHeader {
+			if _, err = reader.Read(); err != nil {
+				for _, ch := range ready {
+					close(ch)
+				}
+				stop.Stop()
+				return result, fmt.Errorf("error reading CSV header: %w", err)
+			}
 		}
 
 		for {
+			select {
+			case <-ctx.Done():
+				interrupted = true
+			case <-allErrored:
+				break readLoop
+			default:
+			}
+			if interrupted {
+				break readLoop
+			}
+
 			record, err := reader.Read()
 			if err == io.EOF {
 				break
 			}
 			if err != nil {
+				for _, ch := range ready {
+					close(ch)
+				}
+				stop.Stop()
 				return result, fmt.Errorf("error reading CSV: %w", err)
 			}
 
-			position, err := config.file.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return result, fmt.Errorf("error getting file position: %w", err)
-			}
+			// InputOffset reflects exactly the bytes consumed for records
+			// read so far, unlike Seek(SeekCurrent) which would report
+			// wherever the reader's internal buffer has read ahead to; a
+			// checkpoint must resume from a true record boundary. It is
+			// relative to seekTo since that's where this iteration's reader
+			// started consuming from.
+			position := seekTo + reader.InputOffset()
+			lastOffset = position
 			overallTracker.SetValue(overallPosition + position)
 
 			i, err := strconv.ParseInt(record[0], 10, 32)
@@ -182,43 +676,91 @@ func ProcessCSV(config Config) (Result, error) {
 				continue
 			}
 
+			partitionIndex := partitionIndexFn(hasher.Hash(documentID))
+			routed := partitionFilterSet == nil || partitionFilterSet[partitionIndex]
+			isOutlier := routed && count > config.outlier && !loggedOutliers[documentID]
+
+			// The dispatch happens before the record is counted below so a row
+			// that arrives after every partition has already errored is
+			// dropped instead of being counted as processed.
+			if routed && !isOutlier {
+				w := partitionIndex % numWorkers
+				select {
+				case ready[w] <- workItem{documentID: documentID, count: count, partitionIndex: partitionIndex}:
+					dispatched[w]++
+				case <-allErrored:
+					break readLoop
+				}
+			}
+
 			result.totalDocuments++
 			result.totalIDs += count
+			recordsThisInvocation++
 
 			messages := []string{
 				fmt.Sprintf("Documents processed: %s\n", humanize.Comma(result.totalDocuments)),
 				fmt.Sprintf("IDs created: %s\n", humanize.Comma(result.totalIDs)),
 			}
 
-			partitionIndex := hash(documentID) % uint32(config.partitions)
-			partition := &partitionList[partitionIndex]
-
-			if count > config.outlier && !loggedOutliers[documentID] {
-				pinnedMessages = append(pinnedMessages, fmt.Sprintf("Skipping outlier DocumentID %d with count %s and partition %d\n", documentID, humanize.Comma(count), partitionIndex))
-				loggedOutliers[documentID] = true
-				continue
+			if routed {
+				if isOutlier {
+					pinnedMessages = append(pinnedMessages, fmt.Sprintf("Skipping outlier DocumentID %d with count %s and partition %d\n", documentID, humanize.Comma(count), partitionIndex))
+					loggedOutliers[documentID] = true
+				} else {
+					config.writer.SetPinnedMessages(append(messages, pinnedMessages...)...)
+				}
 			}
 
-			config.writer.SetPinnedMessages(append(messages, pinnedMessages...)...)
-
-			if !partition.errored {
-				newValue := partition.current + count
-				if newValue > partition.max {
-					partitionTrackers[partitionIndex].IncrementWithError(partition.max - partition.current)
-					config.writer.Log(fmt.Sprintf("Partition %d exceeded maximum value\n", partitionIndex))
-					partition.errored = true
-					erroredPartitions++
-					if erroredPartitions == config.partitions {
-						break
+			if store != nil {
+				rowsSinceCheckpoint++
+				if rowsSinceCheckpoint >= config.checkpointEvery {
+					// The reader only knows a row has been dispatched, not that the
+					// owning worker has applied it to partitionList yet, so wait for
+					// the two to catch up before committing; otherwise a row already
+					// counted into result/position could still be unapplied on disk.
+					waitForWorkersCaughtUp(dispatched, applied, allErrored)
+					if err := store.checkpoint(partitionList, result, loggedOutliers, position); err != nil {
+						for _, ch := range ready {
+							close(ch)
+						}
+						stop.Stop()
+						return result, fmt.Errorf("error checkpointing state: %w", err)
+					}
+					rowsSinceCheckpoint = 0
+					if config.onCheckpoint != nil {
+						config.onCheckpoint(position)
 					}
-				} else {
-					increment := newValue - partition.current
-					partition.current = newValue
-					partitionTrackers[partitionIndex].Increment(increment)
-					result.partitionCounts[partitionIndex] = newValue
 				}
 			}
+
+			if config.maxRecords > 0 && recordsThisInvocation >= config.maxRecords {
+				lastOffset = position
+				maxRecordsReached = true
+				break readLoop
+			}
+		}
+	}
+
+	for _, ch := range ready {
+		close(ch)
+	}
+	stop.Stop()
+
+	if interrupted {
+		if store != nil {
+			if err := store.checkpoint(partitionList, result, loggedOutliers, lastOffset); err != nil {
+				return result, fmt.Errorf("error checkpointing state: %w", err)
+			}
+			if config.onCheckpoint != nil {
+				config.onCheckpoint(lastOffset)
+			}
 		}
+		return result, errInterrupted
+	}
+
+	if maxRecordsReached {
+		result.resumeToken = buildResumeToken(partitionList, lastOffset)
+		return result, errMaxRecordsReached
 	}
 
 	position, err := config.file.Seek(0, io.SeekCurrent)
@@ -234,16 +776,107 @@ func ProcessCSV(config Config) (Result, error) {
 
 	config.writer.SetPinnedMessages(append(messages, pinnedMessages...)...)
 
-	if erroredPartitions == config.partitions {
+	finalErrored := int(atomic.LoadInt64(&erroredPartitions))
+	if finalErrored == config.partitions {
 		return result, fmt.Errorf("all partitions have exceeded their maximum value")
-	} else if erroredPartitions == 1 {
-		return result, fmt.Errorf("%d partition exceeded its maximum value", erroredPartitions)
-	} else if erroredPartitions > 0 {
-		return result, fmt.Errorf("%d partitions exceeded their maximum value", erroredPartitions)
+	} else if finalErrored == 1 {
+		return result, fmt.Errorf("%d partition exceeded its maximum value", finalErrored)
+	} else if finalErrored > 0 {
+		return result, fmt.Errorf("%d partitions exceeded their maximum value", finalErrored)
 	}
 	return result, nil
 }
 
+// waitForWorkersCaughtUp blocks until every worker has applied every row
+// dispatched to it so far, so a checkpoint taken right afterward always
+// matches the row count it's stamped with. It gives up early if allErrored
+// fires, since every worker exits (after flushing) once that happens.
+func waitForWorkersCaughtUp(dispatched, applied []int64, allErrored chan struct{}) {
+	for w := range dispatched {
+		for atomic.LoadInt64(&applied[w]) < dispatched[w] {
+			select {
+			case <-allErrored:
+				return
+			default:
+				runtime.Gosched()
+			}
+		}
+	}
+}
+
+// runPartitionWorker owns every partition index i where i%numWorkers==id and
+// applies count updates read off its ready channel. Because partitionList and
+// partitionTrackers are partitioned disjointly across workers, no locking is
+// needed around either. Tracker increments are batched every progressBatch
+// records to keep go-pretty's internal locking off the hot path.
+func runPartitionWorker(id, numWorkers int, config Config, items <-chan workItem, partitionList []Partition, partitionTrackers []*progress.Tracker, partitionCounts []int64, erroredPartitions *int64, allErrored chan struct{}, allErroredOnce *sync.Once, applied *int64) {
+	pending := make([]int64, len(partitionList))
+	sinceFlush := 0
+
+	flush := func(partitionIndex int) {
+		if pending[partitionIndex] != 0 {
+			partitionTrackers[partitionIndex].Increment(pending[partitionIndex])
+			pending[partitionIndex] = 0
+		}
+	}
+
+	flushAll := func() {
+		for i := id; i < len(partitionList); i += numWorkers {
+			flush(i)
+		}
+	}
+
+	for {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				flushAll()
+				return
+			}
+
+			partition := &partitionList[item.partitionIndex]
+			if atomic.LoadInt32(&partition.errored) != 0 {
+				atomic.AddInt64(applied, 1)
+				continue
+			}
+
+			current := atomic.LoadInt64(&partition.current)
+			newValue := current + item.count
+			if newValue > partition.max {
+				flush(item.partitionIndex)
+				partitionTrackers[item.partitionIndex].IncrementWithError(partition.max - current)
+				config.writer.Log(fmt.Sprintf("Partition %d exceeded maximum value\n", item.partitionIndex))
+				atomic.StoreInt32(&partition.errored, 1)
+				reachedGlobal := atomic.AddInt64(erroredPartitions, 1) == int64(config.partitions)
+				if reachedGlobal {
+					allErroredOnce.Do(func() { close(allErrored) })
+				}
+				atomic.AddInt64(applied, 1)
+				continue
+			}
+
+			increment := newValue - current
+			atomic.StoreInt64(&partition.current, newValue)
+			partitionCounts[item.partitionIndex] = newValue
+
+			pending[item.partitionIndex] += increment
+			sinceFlush++
+			if sinceFlush >= progressBatch {
+				flush(item.partitionIndex)
+				sinceFlush = 0
+			}
+			atomic.AddInt64(applied, 1)
+		case <-allErrored:
+			// waitForWorkersCaughtUp gives up as soon as this fires (it
+			// doesn't wait for applied to catch up to dispatched), so
+			// there's no need to drain whatever's still buffered in items
+			// before exiting.
+			flushAll()
+			return
+		}
+	}
+}
+
 // Based on Postgres hash_bytes_uint32 (https://doxygen.postgresql.org/hashfn_8c_source.html)
 func hash(k uint32) uint32 {
 	a := uint32(0x9e3779b9 + 4 + 3923095)
@@ -273,3 +906,146 @@ func hash(k uint32) uint32 {
 func rotateLeft(x uint32, k uint) uint32 {
 	return (x << k) | (x >> (32 - k))
 }
+
+// Hasher maps a documentID to a partition-independent hash value; ProcessCSV
+// reduces it mod the partition count to pick a partition.
+type Hasher interface {
+	Name() string
+	Hash(documentID uint32) uint32
+}
+
+// parsePartitionFilter expands a -partition-filter spec like "0-63,100,200-205"
+// into the individual partition indexes it selects.
+func parsePartitionFilter(spec string) ([]int, error) {
+	var filter []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid partition index %q: %w", part, err)
+			}
+			filter = append(filter, v)
+			continue
+		}
+
+		loVal, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", part, err)
+		}
+		hiVal, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", part, err)
+		}
+		if hiVal < loVal {
+			return nil, fmt.Errorf("invalid range %q: end before start", part)
+		}
+		for i := loVal; i <= hiVal; i++ {
+			filter = append(filter, i)
+		}
+	}
+	return filter, nil
+}
+
+// NewHasher resolves a Hasher by the name accepted by the -hasher flag.
+func NewHasher(name string) (Hasher, error) {
+	switch name {
+	case "", "postgres":
+		return postgresHasher{}, nil
+	case "fnv1a":
+		return fnv1aHasher{}, nil
+	case "murmur3":
+		return murmur3Hasher{}, nil
+	case "crc32":
+		return crc32Hasher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown hasher %q", name)
+	}
+}
+
+// documentIDBytes renders a documentID the same way for every Hasher
+// implementation that needs a byte slice to feed into a stdlib/third-party hash.
+func documentIDBytes(documentID uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], documentID)
+	return buf[:]
+}
+
+// postgresHasher replicates Postgres's hash_bytes_uint32, the tool's
+// original (and still default) partitioning behavior.
+type postgresHasher struct{}
+
+func (postgresHasher) Name() string { return "postgres" }
+
+func (postgresHasher) Hash(documentID uint32) uint32 { return hash(documentID) }
+
+// fnv1aHasher uses the stdlib FNV-1a implementation.
+type fnv1aHasher struct{}
+
+func (fnv1aHasher) Name() string { return "fnv1a" }
+
+func (fnv1aHasher) Hash(documentID uint32) uint32 {
+	h := fnv.New32a()
+	h.Write(documentIDBytes(documentID))
+	return h.Sum32()
+}
+
+// murmur3Hasher uses the MurmurHash3 x86_32 implementation from
+// github.com/twmb/murmur3.
+type murmur3Hasher struct{}
+
+func (murmur3Hasher) Name() string { return "murmur3" }
+
+func (murmur3Hasher) Hash(documentID uint32) uint32 {
+	return murmur3.Sum32(documentIDBytes(documentID))
+}
+
+// crc32Hasher uses the stdlib IEEE CRC-32 polynomial.
+type crc32Hasher struct{}
+
+func (crc32Hasher) Name() string { return "crc32" }
+
+func (crc32Hasher) Hash(documentID uint32) uint32 {
+	return crc32.ChecksumIEEE(documentIDBytes(documentID))
+}
+
+// printDistributionReport hashes a fixed sample of document IDs through
+// every known Hasher and prints one chi-squared goodness-of-fit statistic per
+// hasher for the given partition count, so users can compare strategies
+// before committing to one.
+func printDistributionReport(partitions int) {
+	if partitions <= 0 {
+		partitions = 1
+	}
+
+	const sampleSize = 1_000_000
+
+	fmt.Printf("Uniformity report (chi-squared, df=%d) over %s sampled IDs across %d partitions:\n",
+		partitions-1, humanize.Comma(sampleSize), partitions)
+
+	for _, name := range []string{"postgres", "fnv1a", "murmur3", "crc32"} {
+		hasher, err := NewHasher(name)
+		if err != nil {
+			continue
+		}
+
+		counts := make([]int64, partitions)
+		for id := uint32(1); id <= sampleSize; id++ {
+			counts[hasher.Hash(id)%uint32(partitions)]++
+		}
+
+		expected := float64(sampleSize) / float64(partitions)
+		chiSquared := 0.0
+		for _, count := range counts {
+			diff := float64(count) - expected
+			chiSquared += diff * diff / expected
+		}
+
+		fmt.Printf("  %-10s chi-squared=%.2f\n", hasher.Name(), chiSquared)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 
@@ -18,44 +22,295 @@ func TestEvenDistribution(t *testing.T) {
 	numRecords := 100000
 	numPartitions := 10
 
+	for _, workers := range []int{1, runtime.NumCPU()} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			tmpfile := createTestCSV(t, numRecords, 1)
+			defer os.Remove(tmpfile.Name())
+
+			result, _, err := runProcessCSV(t, tmpfile, Config{partitions: numPartitions, workers: workers})
+			require.NoError(t, err)
+
+			assert.EqualValues(t, numRecords, result.totalDocuments)
+			assert.EqualValues(t, numRecords, result.totalIDs)
+
+			expectedCount := numRecords / numPartitions
+			deviation := 0.05
+
+			lowerBound := int64(float64(expectedCount) * (1 - deviation))
+			upperBound := int64(float64(expectedCount) * (1 + deviation))
+
+			for i, count := range result.partitionCounts {
+				assert.GreaterOrEqual(t, count, lowerBound, "Partition %d has too few records: %d vs %d", i, count, lowerBound)
+				assert.LessOrEqual(t, count, upperBound, "Partition %d has too many records: %d vs %d", i, count, upperBound)
+			}
+		})
+	}
+}
+
+func TestAllPartitionsErrored(t *testing.T) {
+	for _, workers := range []int{1, runtime.NumCPU()} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			tmpfile := createTestCSV(t, 10, 11)
+			defer os.Remove(tmpfile.Name())
+
+			result, output, err := runProcessCSV(t, tmpfile, Config{partitions: 3, max: 10, workers: workers})
+
+			require.Error(t, err)
+			// The ready channels are buffered, so the reader can race ahead of
+			// the workers noticing every partition has errored by up to the
+			// buffer depth; with only 10 rows in this file that means it may
+			// end up reading anywhere from the row that trips the last
+			// partition through the rest of the file before allErrored stops
+			// it. Assert the bound instead of an exact row count.
+			assert.GreaterOrEqual(t, result.totalDocuments, int64(3))
+			assert.LessOrEqual(t, result.totalDocuments, int64(10))
+			assert.EqualValues(t, result.totalDocuments*11, result.totalIDs)
+
+			expectedError := "all partitions have exceeded their maximum value"
+			assert.Equal(t, expectedError, err.Error(), "Unexpected error message")
+
+			assert.Contains(t, output, "Partition 000", "Expected progress bar for partition 0")
+			assert.Contains(t, output, "Partition 001", "Expected progress bar for partition 1")
+			assert.Contains(t, output, "Partition 002", "Expected progress bar for partition 2")
+			assert.Contains(t, output, "Total Progress", "Expected overall progress bar")
+		})
+	}
+}
+
+// TestSkewedPartitionDoesNotDeadlock covers a worker that owns only
+// partitions which have all errored while other partitions are still
+// healthy: the reader must keep making progress sending it further rows
+// instead of blocking forever, since that worker keeps consuming (and
+// dropping) them rather than exiting early. DocumentIDs 1 and 2 route to
+// partition 0 and 3 routes to partition 1 under postgresHasher's bitmask
+// partitioning.
+func TestSkewedPartitionDoesNotDeadlock(t *testing.T) {
+	tmpfile := createSkewedTestCSV(t)
+	defer os.Remove(tmpfile.Name())
+
+	done := make(chan struct{})
+	var result Result
+	var procErr error
+	go func() {
+		result, _, procErr = runProcessCSV(t, tmpfile, Config{partitions: 2, max: 10, workers: 2})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessCSV did not return: the reader blocked sending to a worker whose own partitions had all already errored")
+	}
+
+	require.Error(t, procErr)
+	assert.Equal(t, "1 partition exceeded its maximum value", procErr.Error())
+	// Partition 0 errors on the very first row, so the reader counts all
+	// three rows (the worker applying the third one just drops it once it
+	// sees partition 0 is already errored, same as any other row that
+	// lands on an already-errored partition).
+	assert.EqualValues(t, 3, result.totalDocuments)
+	assert.EqualValues(t, 102, result.totalIDs)
+}
+
+func createSkewedTestCSV(t *testing.T) *os.File {
+	var csvData bytes.Buffer
+	csvData.WriteString("DocumentID,count\n")
+	csvData.WriteString("1,100\n") // partition 0: overflows immediately
+	csvData.WriteString("3,1\n")   // partition 1: stays healthy
+	csvData.WriteString("2,1\n")   // partition 0 again: must not block the reader
+
+	tmpfile, err := ioutil.TempFile("", "skewed.csv")
+	require.NoError(t, err)
+
+	_, err = tmpfile.Write(csvData.Bytes())
+	require.NoError(t, err)
+	_, err = tmpfile.Seek(0, 0)
+	require.NoError(t, err)
+
+	return tmpfile
+}
+
+// TestCheckpointResumeReportsPriorErrors covers resuming a run where a
+// partition had already exceeded its maximum before the checkpoint was
+// taken: the resumed run must still report that partition in its final
+// error instead of only counting errors newly encountered this invocation.
+func TestCheckpointResumeReportsPriorErrors(t *testing.T) {
+	var csvData bytes.Buffer
+	csvData.WriteString("DocumentID,count\n")
+	csvData.WriteString("1,100\n")
+	for i := 2; i <= 10; i++ {
+		csvData.WriteString(fmt.Sprintf("%d,1\n", i))
+	}
+
+	tmpfile, err := ioutil.TempFile("", "resume-error.csv")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(csvData.Bytes())
+	require.NoError(t, err)
+	_, err = tmpfile.Seek(0, 0)
+	require.NoError(t, err)
+
+	stateDir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstRun, _, err := runProcessCSV(t, tmpfile, Config{
+		partitions:      2,
+		max:             10,
+		stateDir:        stateDir,
+		checkpointEvery: 1,
+		ctx:             ctx,
+		onCheckpoint:    func(offset int64) { cancel() },
+	})
+	require.ErrorIs(t, err, errInterrupted)
+	assert.Less(t, firstRun.totalDocuments, int64(10))
+
+	secondRun, _, err := runProcessCSV(t, tmpfile, Config{
+		partitions: 2,
+		max:        10,
+		stateDir:   stateDir,
+	})
+
+	require.Error(t, err, "a partition that already exceeded its maximum before the checkpoint must still be reported after resuming")
+	assert.NotEqual(t, 0, secondRun.totalDocuments)
+}
+
+func TestCheckpointResume(t *testing.T) {
+	numRecords := 5000
+	numPartitions := 5
+
 	tmpfile := createTestCSV(t, numRecords, 1)
 	defer os.Remove(tmpfile.Name())
 
-	result, _, err := runProcessCSV(t, tmpfile, Config{partitions: numPartitions})
+	reference, _, err := runProcessCSV(t, tmpfile, Config{partitions: numPartitions})
 	require.NoError(t, err)
 
-	assert.EqualValues(t, numRecords, result.totalDocuments)
-	assert.EqualValues(t, numRecords, result.totalIDs)
+	stateDir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstRun, _, err := runProcessCSV(t, tmpfile, Config{
+		partitions:      numPartitions,
+		stateDir:        stateDir,
+		checkpointEvery: 100,
+		ctx:             ctx,
+		onCheckpoint:    func(offset int64) { cancel() },
+	})
+	require.ErrorIs(t, err, errInterrupted)
+	assert.Less(t, firstRun.totalDocuments, int64(numRecords))
+
+	secondRun, _, err := runProcessCSV(t, tmpfile, Config{
+		partitions: numPartitions,
+		stateDir:   stateDir,
+	})
+	require.NoError(t, err)
 
-	expectedCount := numRecords / numPartitions
-	deviation := 0.05
+	assert.EqualValues(t, numRecords, secondRun.totalDocuments)
+	assert.Equal(t, reference.partitionCounts, secondRun.partitionCounts)
+}
 
-	lowerBound := int64(float64(expectedCount) * (1 - deviation))
-	upperBound := int64(float64(expectedCount) * (1 + deviation))
+// TestCheckpointPeriodicConsistency guards against a periodic checkpoint
+// committing partitionList before every dispatched row has actually been
+// applied by its worker. It stops the run right as the first periodic
+// checkpoint fires (maxRecords == checkpointEvery) without ever going
+// through the interrupted path's full drain-then-checkpoint, so the state
+// left on disk is exactly what the periodic path committed.
+func TestCheckpointPeriodicConsistency(t *testing.T) {
+	numRecords := 5000
+	numPartitions := 8
+	checkpointEvery := int64(2000)
 
-	for i, count := range result.partitionCounts {
-		assert.GreaterOrEqual(t, count, lowerBound, "Partition %d has too few records: %d vs %d", i, count, lowerBound)
-		assert.LessOrEqual(t, count, upperBound, "Partition %d has too many records: %d vs %d", i, count, upperBound)
+	tmpfile := createTestCSV(t, numRecords, 1)
+	defer os.Remove(tmpfile.Name())
+
+	reference, _, err := runProcessCSV(t, tmpfile, Config{partitions: numPartitions, maxRecords: checkpointEvery})
+	require.ErrorIs(t, err, errMaxRecordsReached)
+
+	for _, workers := range []int{2, runtime.NumCPU()} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			stateDir := t.TempDir()
+
+			_, _, err := runProcessCSV(t, tmpfile, Config{
+				partitions:      numPartitions,
+				workers:         workers,
+				stateDir:        stateDir,
+				checkpointEvery: checkpointEvery,
+				maxRecords:      checkpointEvery,
+			})
+			require.ErrorIs(t, err, errMaxRecordsReached)
+
+			store, err := openStore(Config{stateDir: stateDir})
+			require.NoError(t, err)
+			defer store.Close()
+
+			partitionList := make([]Partition, numPartitions)
+			restored := Result{partitionCounts: make([]int64, numPartitions)}
+			_, err = store.restore(partitionList, &restored, map[uint32]bool{})
+			require.NoError(t, err)
+
+			assert.Equal(t, reference.partitionCounts, restored.partitionCounts)
+		})
 	}
 }
 
-func TestAllPartitionsErrored(t *testing.T) {
-	tmpfile := createTestCSV(t, 10, 11)
+func TestMaxRecordsResumeToken(t *testing.T) {
+	numRecords := 5000
+	numPartitions := 5
+	numChunks := 5
+
+	tmpfile := createTestCSV(t, numRecords, 1)
 	defer os.Remove(tmpfile.Name())
 
-	result, output, err := runProcessCSV(t, tmpfile, Config{partitions: 3, max: 10})
+	reference, _, err := runProcessCSV(t, tmpfile, Config{partitions: numPartitions})
+	require.NoError(t, err)
 
-	require.Error(t, err)
-	assert.EqualValues(t, result.totalDocuments, 3)
-	assert.EqualValues(t, result.totalIDs, 33)
+	var resumeFrom *ResumeToken
+	var lastResult Result
+	for i := 0; i < numChunks; i++ {
+		// The final chunk leaves maxRecords unset so it simply drains
+		// whatever remains instead of racing the cap against EOF.
+		var maxRecords int64
+		if i < numChunks-1 {
+			maxRecords = int64(numRecords / numChunks)
+		}
+
+		result, _, err := runProcessCSV(t, tmpfile, Config{
+			partitions: numPartitions,
+			maxRecords: maxRecords,
+			resumeFrom: resumeFrom,
+		})
+
+		if i < numChunks-1 {
+			require.ErrorIs(t, err, errMaxRecordsReached)
+			resumeFrom = &result.resumeToken
+		} else {
+			require.NoError(t, err)
+			lastResult = result
+		}
+	}
+
+	assert.Equal(t, reference.partitionCounts, lastResult.partitionCounts)
+}
+
+func TestPartitionFilter(t *testing.T) {
+	numRecords := 2000
+	numPartitions := 4
+
+	tmpfile := createTestCSV(t, numRecords, 1)
+	defer os.Remove(tmpfile.Name())
 
-	expectedError := "all partitions have exceeded their maximum value"
-	assert.Equal(t, expectedError, err.Error(), "Unexpected error message")
+	reference, _, err := runProcessCSV(t, tmpfile, Config{partitions: numPartitions})
+	require.NoError(t, err)
+
+	result, _, err := runProcessCSV(t, tmpfile, Config{
+		partitions:      numPartitions,
+		partitionFilter: []int{0, 2},
+	})
+	require.NoError(t, err)
 
-	assert.Contains(t, output, "Partition 000", "Expected progress bar for partition 3")
-	assert.Contains(t, output, "Partition 001", "Expected progress bar for partition 1")
-	assert.Contains(t, output, "Partition 002", "Expected progress bar for partition 2")
-	assert.Contains(t, output, "Total Progress", "Expected overall progress bar")
+	assert.EqualValues(t, numRecords, result.totalDocuments, "rows outside the filter still advance the overall count")
+	assert.Equal(t, reference.partitionCounts[0], result.partitionCounts[0])
+	assert.Equal(t, reference.partitionCounts[2], result.partitionCounts[2])
+	assert.Zero(t, result.partitionCounts[1], "partition 1 is outside the filter and should not be routed to")
+	assert.Zero(t, result.partitionCounts[3], "partition 3 is outside the filter and should not be routed to")
 }
 
 func createTestCSV(t *testing.T, numDocuments int, count int) *os.File {
@@ -76,30 +331,52 @@ func createTestCSV(t *testing.T, numDocuments int, count int) *os.File {
 	return tmpfile
 }
 
-// FIXME The postgres implementation returns signed values
-//func TestHash(t *testing.T) {
-//	testCases := []struct {
-//		input    uint32
-//		expected int32
-//	}{
-//		{input: 123456789, expected: 524883300},
-//		{input: 987654321, expected: -522295545},
-//		{input: 1, expected: -1905060026},
-//		{input: 2147483647, expected: -96758253}, // 2^31 - 1
-//		{input: 42, expected: 1509752520},
-//		{input: 314159265, expected: -489000246},
-//		{input: 271828182, expected: -562529542},
-//		{input: 1618033988, expected: -1731020505},
-//		{input: 272321, expected: 235424784},
-//	}
-//
-//	for _, tc := range testCases {
-//		t.Run(fmt.Sprintf("input_%d", tc.input), func(t *testing.T) {
-//			result := hash(tc.input)
-//			assert.Equal(t, tc.expected, result, "Hash result doesn't match expected value for input %d", tc.input)
-//		})
-//	}
-//}
+func TestHash(t *testing.T) {
+	inputs := []uint32{123456789, 987654321, 1, 2147483647, 42, 314159265, 271828182, 1618033988, 272321}
+
+	testCases := []struct {
+		hasherName string
+		expected   []uint32
+	}{
+		{
+			hasherName: "postgres",
+			expected:   []uint32{524883300, 3772671751, 2389907270, 4198209043, 1509752520, 3805967050, 3732437754, 2563946791, 235424784},
+		},
+		{
+			hasherName: "fnv1a",
+			expected:   []uint32{687972593, 122593638, 1251341186, 352209201, 831900711, 1361962599, 2092437874, 1610722755, 257376105},
+		},
+		{
+			hasherName: "murmur3",
+			expected:   []uint32{1906046938, 981446823, 854115492, 1792945001, 356355534, 180239690, 2939523538, 4103416696, 1404468478},
+		},
+		{
+			hasherName: "crc32",
+			expected:   []uint32{3488836380, 679984470, 1447292810, 312887748, 4211021514, 1422899281, 2539042529, 1409869647, 283850627},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.hasherName, func(t *testing.T) {
+			hasher, err := NewHasher(tc.hasherName)
+			require.NoError(t, err)
+
+			require.Equal(t, len(inputs), len(tc.expected), "test case is missing expected values")
+
+			for i, input := range inputs {
+				t.Run(fmt.Sprintf("input_%d", input), func(t *testing.T) {
+					result := hasher.Hash(input)
+					assert.Equal(t, tc.expected[i], result, "Hash result doesn't match expected value for input %d", input)
+				})
+			}
+		})
+	}
+}
+
+func TestNewHasherUnknown(t *testing.T) {
+	_, err := NewHasher("does-not-exist")
+	require.Error(t, err)
+}
 
 func runProcessCSV(t *testing.T, file *os.File, userConfig Config) (Result, string, error) {
 	pw := progress.NewWriter()
@@ -113,14 +390,17 @@ func runProcessCSV(t *testing.T, file *os.File, userConfig Config) (Result, stri
 	require.NoError(t, err)
 
 	defaultConfig := Config{
-		iterations: 1,
-		partitions: 1,
-		max:        math.MaxInt64,
-		min:        0,
-		file:       file,
-		writer:     pw,
-		fileSize:   fileInfo.Size(),
-		outlier:    math.MaxInt64,
+		iterations:      1,
+		partitions:      1,
+		max:             math.MaxInt64,
+		min:             0,
+		file:            file,
+		writer:          pw,
+		fileSize:        fileInfo.Size(),
+		outlier:         math.MaxInt64,
+		workers:         1,
+		checkpointEvery: math.MaxInt64,
+		hasher:          postgresHasher{},
 	}
 
 	config := mergeConfig(defaultConfig, userConfig)
@@ -169,6 +449,163 @@ func mergeConfig(defaultConfig Config, userConfig Config) Config {
 	if userConfig.fileSize != 0 {
 		mergedConfig.fileSize = userConfig.fileSize
 	}
+	if userConfig.workers != 0 {
+		mergedConfig.workers = userConfig.workers
+	}
+	if userConfig.stateDir != "" {
+		mergedConfig.stateDir = userConfig.stateDir
+	}
+	if userConfig.checkpointEvery != 0 {
+		mergedConfig.checkpointEvery = userConfig.checkpointEvery
+	}
+	if userConfig.reset {
+		mergedConfig.reset = userConfig.reset
+	}
+	if userConfig.ctx != nil {
+		mergedConfig.ctx = userConfig.ctx
+	}
+	if userConfig.onCheckpoint != nil {
+		mergedConfig.onCheckpoint = userConfig.onCheckpoint
+	}
+	if userConfig.hasher != nil {
+		mergedConfig.hasher = userConfig.hasher
+	}
+	if userConfig.maxRecords != 0 {
+		mergedConfig.maxRecords = userConfig.maxRecords
+	}
+	if userConfig.partitionFilter != nil {
+		mergedConfig.partitionFilter = userConfig.partitionFilter
+	}
+	if userConfig.resumeFrom != nil {
+		mergedConfig.resumeFrom = userConfig.resumeFrom
+	}
 
 	return mergedConfig
 }
+
+// BenchmarkProcessCSV compares the modulo and mask-based partition indexing
+// paths at partition counts that are and aren't a power of two. 1023 and
+// 1024 isolate just the mod-vs-mask choice (partition tracker counts only
+// one apart), unlike the other pairs here which also change how
+// many trackers get updated.
+func BenchmarkProcessCSV(b *testing.B) {
+	const numRecords = 10_000_000
+
+	tmpfile := createBenchmarkCSV(b, numRecords)
+	defer os.Remove(tmpfile.Name())
+
+	fileInfo, err := tmpfile.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, partitions := range []int{8, 10, 16, 1023, 1024} {
+		b.Run(fmt.Sprintf("partitions=%d", partitions), func(b *testing.B) {
+			pw := progress.NewWriter()
+			pw.SetAutoStop(true)
+			pw.SetOutputWriter(io.Discard)
+
+			config := Config{
+				iterations:      1,
+				partitions:      partitions,
+				max:             math.MaxInt64,
+				min:             0,
+				file:            tmpfile,
+				writer:          pw,
+				fileSize:        fileInfo.Size(),
+				outlier:         math.MaxInt64,
+				workers:         1,
+				checkpointEvery: math.MaxInt64,
+				hasher:          postgresHasher{},
+			}
+
+			go pw.Render()
+			for !pw.IsRenderInProgress() {
+				time.Sleep(time.Millisecond)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessCSV(config); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			pw.Stop()
+		})
+	}
+}
+
+// BenchmarkWorkerScaling compares -workers settings against each other to
+// check whether the per-partition worker pool actually buys throughput, or
+// whether the single-goroutine CSV read/parse ahead of it dominates.
+func BenchmarkWorkerScaling(b *testing.B) {
+	const numRecords = 2_000_000
+
+	tmpfile := createBenchmarkCSV(b, numRecords)
+	defer os.Remove(tmpfile.Name())
+
+	fileInfo, err := tmpfile.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			pw := progress.NewWriter()
+			pw.SetAutoStop(true)
+			pw.SetOutputWriter(io.Discard)
+
+			config := Config{
+				iterations:      1,
+				partitions:      16,
+				max:             math.MaxInt64,
+				min:             0,
+				file:            tmpfile,
+				writer:          pw,
+				fileSize:        fileInfo.Size(),
+				outlier:         math.MaxInt64,
+				workers:         workers,
+				checkpointEvery: math.MaxInt64,
+				hasher:          postgresHasher{},
+			}
+
+			go pw.Render()
+			for !pw.IsRenderInProgress() {
+				time.Sleep(time.Millisecond)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessCSV(config); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			pw.Stop()
+		})
+	}
+}
+
+func createBenchmarkCSV(b *testing.B, numDocuments int) *os.File {
+	tmpfile, err := ioutil.TempFile("", "bench.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	w := bufio.NewWriter(tmpfile)
+	w.WriteString("DocumentID,count\n")
+	for i := 1; i <= numDocuments; i++ {
+		fmt.Fprintf(w, "%d,%d\n", i, 1)
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := tmpfile.Seek(0, 0); err != nil {
+		b.Fatal(err)
+	}
+
+	return tmpfile
+}